@@ -0,0 +1,35 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package watch
+
+// AckOptions is the body of POST /watch/ack: the cursor a ClientID has
+// successfully processed up to, so a later reconnect with the same
+// ClientID resumes from here instead of replaying already handled events.
+type AckOptions struct {
+	Resource   CursorType  `json:"bk_resource"`
+	ClientID   string      `json:"bk_client_id"`
+	EventTypes []EventType `json:"bk_event_types,omitempty"`
+	Fields     []string    `json:"bk_fields,omitempty"`
+	Cursor     string      `json:"bk_cursor"`
+}
+
+// LeaseOptions is the body of POST /watch/lease/renew and
+// POST /watch/lease/drop: which client's durable subscription to act on.
+// LeaseID is optional; when set it must match the lease's current LeaseID,
+// fencing a stale client instance off from renewing or dropping a lease a
+// newer instance of the same ClientID has since re-registered.
+type LeaseOptions struct {
+	Resource CursorType `json:"bk_resource"`
+	ClientID string     `json:"bk_client_id"`
+	LeaseID  string     `json:"bk_lease_id,omitempty"`
+}
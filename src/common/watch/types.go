@@ -0,0 +1,111 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package watch holds the wire types shared by event_server's watch
+// endpoints and coreservice's event package: the request/response shapes
+// and the cursor-chain node layout, so neither side has to guess at the
+// other's json tags.
+package watch
+
+import "errors"
+
+// CursorType names the resource a cursor chain watches, e.g. "host",
+// "biz", "module".
+type CursorType string
+
+// EventType is the kind of change a single chain node records.
+type EventType string
+
+const (
+	EventTypeCreate EventType = "create"
+	EventTypeUpdate EventType = "update"
+	EventTypeDelete EventType = "delete"
+)
+
+// NoEventCursor is returned in place of a real cursor when a watch round
+// timed out without finding a single event, telling the caller to resume
+// from the chain's head on its next request instead of replaying this
+// round.
+const NoEventCursor = "NoEventCursor"
+
+// JsonString is a pre-encoded json document, kept as a string so it can be
+// forwarded to a WatchEventResp without being unmarshaled and remarshaled.
+type JsonString string
+
+// TimeStamp is the cluster time a chain node was written at, mirroring a
+// mongodb timestamp's (seconds, ordinal) pair.
+type TimeStamp struct {
+	Sec  uint32 `json:"sec" bson:"sec"`
+	Nano uint32 `json:"nano" bson:"nano"`
+}
+
+// ChainNode is a single link in a resource's cursor chain: the cursor that
+// names it, the cursor that follows it, and enough metadata about the
+// event it represents to decide whether a watcher is interested without
+// reading the event's full detail.
+type ChainNode struct {
+	Cursor      string    `json:"cursor" bson:"cursor"`
+	NextCursor  string    `json:"next_cursor" bson:"next_cursor"`
+	ClusterTime TimeStamp `json:"cluster_time" bson:"cluster_time"`
+	EventType   EventType `json:"event_type" bson:"event_type"`
+	// Attrs carries the detail fields that are cheap to index (e.g.
+	// bk_biz_id, bk_supplier_account, bk_obj_id), copied here at write
+	// time so a Filter predicate against one of them can be evaluated
+	// without a separate detail read.
+	Attrs map[string]interface{} `json:"attrs,omitempty" bson:"attrs,omitempty"`
+}
+
+// WatchEventOptions is the body of a watch request: which resource, where
+// to resume from, and how to narrow down the events returned.
+type WatchEventOptions struct {
+	Resource CursorType `json:"bk_resource"`
+	// Cursor resumes a watch right after the event it names. Mutually
+	// exclusive with StartFrom; leaving both unset watches from now.
+	Cursor string `json:"bk_cursor,omitempty"`
+	// StartFrom resumes a watch from this unix-seconds cluster time.
+	StartFrom int64 `json:"bk_start_from,omitempty"`
+	// ClientID resumes a watch from the cursor this client last acked via
+	// WatchEventAck. Only consulted when both Cursor and StartFrom are
+	// unset; a client that's never acked watches from the chain's head.
+	ClientID   string      `json:"bk_client_id,omitempty"`
+	EventTypes []EventType `json:"bk_event_types,omitempty"`
+	Fields     []string    `json:"bk_fields,omitempty"`
+	// Filter narrows the events returned to ones matching every condition.
+	// Conditions on indexed fields are resolved from a ChainNode's Attrs
+	// without a detail read; the rest fall back to the event's full detail.
+	Filter []FilterCondition `json:"bk_filter,omitempty"`
+}
+
+// Validate reports whether options is well formed enough to watch with.
+func (o *WatchEventOptions) Validate() error {
+	if len(o.Resource) == 0 {
+		return errors.New("bk_resource is required")
+	}
+	if len(o.Cursor) != 0 && o.StartFrom != 0 {
+		return errors.New("bk_cursor and bk_start_from are mutually exclusive")
+	}
+	return nil
+}
+
+// WatchEventResp is a single event as returned to a watch caller: the
+// cursor to resume from next, and the (possibly field-trimmed) detail, empty
+// when the round produced no matching event.
+type WatchEventResp struct {
+	Cursor   string     `json:"bk_cursor"`
+	Resource CursorType `json:"bk_resource"`
+	Detail   JsonString `json:"bk_detail"`
+	// GapDetected is true when resuming this watch from the caller's lease
+	// found it had already fallen off the chain's head, so events between
+	// the lease's last cursor and this response's Cursor were lost and the
+	// caller needs to resync instead of assuming it saw every event.
+	GapDetected bool `json:"bk_gap_detected,omitempty"`
+}
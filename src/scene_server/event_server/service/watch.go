@@ -13,6 +13,7 @@
 package service
 
 import (
+	"context"
 	ejson "encoding/json"
 	"errors"
 	"net/http"
@@ -25,14 +26,25 @@ import (
 	"configcenter/src/common/util"
 	"configcenter/src/common/watch"
 	"configcenter/src/source_controller/coreservice/event"
+	"configcenter/src/source_controller/coreservice/event/metrics"
 	"github.com/emicklei/go-restful"
-	"gopkg.in/redis.v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// tracer carries one span per WatchEvent request, so the 25s long-poll can
+// be correlated with the redis calls it makes downstream in whatever
+// tracing backend is wired up.
+var tracer = otel.Tracer("configcenter/event_server/watch")
+
 func (s *Service) WatchEvent(req *restful.Request, resp *restful.Response) {
 	header := req.Request.Header
 	rid := util.GetHTTPCCRequestID(header)
 	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+	// derive from the underlying request so a client disconnect is observed
+	// by the long-poll loop instead of running it to completion regardless.
+	ctx, span := tracer.Start(req.Request.Context(), "WatchEvent")
+	defer span.End()
 
 	resource := req.PathParameter("resource")
 	options := new(watch.WatchEventOptions)
@@ -50,6 +62,15 @@ func (s *Service) WatchEvent(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	span.SetAttributes(
+		attribute.String("resource", string(options.Resource)),
+		attribute.String("cursor", options.Cursor),
+		attribute.Int64("start_from", options.StartFrom),
+	)
+
+	metrics.ActiveClients.WithLabelValues(string(options.Resource)).Inc()
+	defer metrics.ActiveClients.WithLabelValues(string(options.Resource)).Dec()
+
 	key, err := event.GetResourceKeyWithCursorType(options.Resource)
 	if err != nil {
 		blog.Errorf("watch event, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
@@ -57,27 +78,55 @@ func (s *Service) WatchEvent(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	var gapDetected bool
+	if len(options.Cursor) == 0 && options.StartFrom == 0 && len(options.ClientID) != 0 {
+		cursor, gap, err := s.resumeFromLease(key, options.ClientID, rid)
+		if err != nil {
+			blog.Errorf("watch event, resume from lease for client: %s failed, err: %v, rid: %s", options.ClientID, err, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+			return
+		}
+		options.Cursor = cursor
+		gapDetected = gap
+		span.SetAttributes(attribute.Bool("lease_gap_detected", gapDetected))
+	}
+
 	// watch with cursor
 	if len(options.Cursor) != 0 {
-		events, err := s.watchWithCursor(key, options, rid)
+		events, err := s.watchWithCursor(ctx, key, options, rid)
 		if err != nil {
+			if ctx.Err() != nil {
+				blog.V(5).Infof("watch event with cursor: %s, client disconnected, rid: %s", options.Cursor, rid)
+				return
+			}
 			blog.Errorf("watch event with cursor failed, cursor: %s, err: %v, rid: %s", options.Cursor, err, rid)
 			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
 			return
 		}
+		if gapDetected && len(events) != 0 {
+			// only the caller that asked to resume by ClientID can have a
+			// gap, so it's enough to flag the first event resuming unblocks.
+			events[0].GapDetected = true
+		}
+		span.SetAttributes(attribute.Int("event_count", len(events)))
 		resp.WriteEntity(events)
 		return
 	}
 
 	// watch with start from
 	if options.StartFrom != 0 {
-		events, err := s.watchWithStartFrom(key, options, rid)
+		events, err := s.watchWithStartFrom(ctx, key, options, rid)
 		if err != nil {
+			if ctx.Err() != nil {
+				blog.V(5).Infof("watch event with start from: %d, client disconnected, rid: %s", options.StartFrom, rid)
+				return
+			}
 			blog.Errorf("watch event with start from: %s, err: %v, rid: %s", time.Unix(options.StartFrom, 0).Format(time.RFC3339), err, rid)
 			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
 			return
 		}
 
+		span.SetAttributes(attribute.Int("event_count", len(events)))
 		resp.WriteEntity(events)
 		return
 	}
@@ -90,10 +139,11 @@ func (s *Service) WatchEvent(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	span.SetAttributes(attribute.Int("event_count", 1))
 	resp.WriteEntity([]*watch.WatchEventResp{events})
 }
 
-func (s *Service) watchWithStartFrom(key event.Key, opts *watch.WatchEventOptions, rid string) ([]*watch.WatchEventResp, error) {
+func (s *Service) watchWithStartFrom(ctx context.Context, key event.Key, opts *watch.WatchEventOptions, rid string) ([]*watch.WatchEventResp, error) {
 
 	// validate start from value is in the range or not
 	headTarget, tailTarget, err := s.getHeadTailNodeTargetNode(key)
@@ -130,32 +180,52 @@ func (s *Service) watchWithStartFrom(key event.Key, opts *watch.WatchEventOption
 		return []*watch.WatchEventResp{latestEvent}, nil
 	}
 
+	store, err := s.getStore(key)
+	if err != nil {
+		blog.Errorf("watch with start from: %d, get configured store failed, err: %v, rid: %s", opts.StartFrom, err, rid)
+		return nil, err
+	}
+
 	// keep scan the cursor chain until to the tail cursor.
-	// start from the head key.
+	// start from the head key, unless the backend keeps a time index that
+	// lets us jump straight past the events older than start from.
 	nextCursor := key.HeadKey()
+	if resolved, ok, err := store.ResolveStartFrom(key, opts.StartFrom); err != nil {
+		blog.Errorf("watch with start from: %d, resolve start cursor failed, err: %v, rid: %s", opts.StartFrom, err, rid)
+		return nil, err
+	} else if ok {
+		nextCursor = resolved
+	}
 	timeout := time.After(25 * time.Second)
 	for {
 		select {
+		case <-ctx.Done():
+			// the caller has already gone away, no point in scanning on.
+			return nil, ctx.Err()
 		case <-timeout:
 			// scan the event's too long time, need to exist immediately.
+			metrics.TimeoutTotal.WithLabelValues(string(opts.Resource), "scan_too_long").Inc()
 			blog.Errorf("watch with start from: %d, scan the cursor chain, but scan too long time, rid: %s", opts.StartFrom, rid)
 			return nil, errors.New("scan the event cost too long time")
 		default:
 
 		}
 
+		metrics.LoopIterationsTotal.WithLabelValues(string(opts.Resource)).Inc()
+
 		// scan event node from head
-		nodes, err := s.getNodesFromCursor(eventStep, nextCursor, key)
+		nodes, err := s.getNodesFromCursor(ctx, eventStep, nextCursor, key)
 		if err != nil {
 			blog.Errorf("get event from head failed, err: %v, rid: %s", err, rid)
 			return nil, err
 		}
+		metrics.ChainScanNodes.WithLabelValues(string(opts.Resource)).Observe(float64(len(nodes)))
 
 		if len(nodes) == 0 {
 			resp := &watch.WatchEventResp{
 				Cursor:   watch.NoEventCursor,
 				Resource: opts.Resource,
-				Detail:   nil,
+				Detail:   "",
 			}
 
 			// at least the tail node should can be scan, so something goes wrong.
@@ -163,7 +233,7 @@ func (s *Service) watchWithStartFrom(key event.Key, opts *watch.WatchEventOption
 			return []*watch.WatchEventResp{resp}, nil
 		}
 
-		hitNodes := getHitNodeWithEventType(nodes, opts.EventTypes)
+		hitNodes := getHitNodes(nodes, opts)
 		matchedNodes := make([]*watch.ChainNode, 0)
 		for _, node := range hitNodes {
 			// find node that cluster time is larger than the start from seconds.
@@ -183,7 +253,7 @@ func (s *Service) watchWithStartFrom(key event.Key, opts *watch.WatchEventOption
 		if lastNode.NextCursor == key.TailKey() {
 			// has already scan to the end, no need to scan anymore
 			// get event detail.
-			detail, err := s.cache.Get(key.DetailKey(lastNode.Cursor)).Result()
+			detail, err := store.GetDetail(key, lastNode.Cursor)
 			if err != nil {
 				blog.Errorf("get cursor: %s detail failed, err: %v, rid: %s", lastNode.Cursor, err, rid)
 				return nil, err
@@ -203,26 +273,40 @@ func (s *Service) watchWithStartFrom(key event.Key, opts *watch.WatchEventOption
 }
 
 func (s *Service) getEventsWithCursorNodes(opts *watch.WatchEventOptions, hitNodes []*watch.ChainNode, key event.Key, rid string) ([]*watch.WatchEventResp, error) {
-	results := make([]*redis.StringCmd, len(hitNodes))
-	pipe := s.cache.Pipeline()
+	store, err := s.getStore(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := make([]string, len(hitNodes))
 	for idx, node := range hitNodes {
-		results[idx] = pipe.Get(key.DetailKey(node.Cursor))
+		cursors[idx] = node.Cursor
 	}
-	_, err := pipe.Exec()
+
+	pipelineStart := time.Now()
+	details, err := store.PipelineGetDetails(key, cursors)
+	metrics.ObserveRedisPipeline("get_details", pipelineStart)
 	if err != nil {
 		blog.Errorf("watch with start from: %d, resource: %s, hit events, but get event detail failed, err: %v, rid: %s",
 			opts.StartFrom, opts.Resource, err, rid)
 		return nil, err
 	}
-	resp := make([]*watch.WatchEventResp, len(hitNodes))
-	for idx, result := range results {
-		jsonStr := result.Val()
+
+	// predicates that couldn't be resolved from the chain node's indexed
+	// Attrs are evaluated here, against the detail we just fetched.
+	_, detailLevel := event.SplitPredicates(event.ToPredicates(opts.Filter))
+
+	resp := make([]*watch.WatchEventResp, 0, len(hitNodes))
+	for idx, jsonStr := range details {
+		if !event.MatchDetail(detailLevel, jsonStr) {
+			continue
+		}
 		cut := json.CutJsonDataWithFields(&jsonStr, opts.Fields)
-		resp[idx] = &watch.WatchEventResp{
+		resp = append(resp, &watch.WatchEventResp{
 			Cursor:   hitNodes[idx].Cursor,
 			Resource: opts.Resource,
 			Detail:   watch.JsonString(*cut),
-		}
+		})
 	}
 	return resp, nil
 }
@@ -234,13 +318,13 @@ func (s *Service) watchFromNow(key event.Key, opts *watch.WatchEventOptions, rid
 		return nil, err
 	}
 
-	hit := getHitNodeWithEventType([]*watch.ChainNode{node}, opts.EventTypes)
+	hit := getHitNodes([]*watch.ChainNode{node}, opts)
 	if len(hit) == 0 {
 		// not matched, set to no event cursor with empty detail
 		return &watch.WatchEventResp{
 			Cursor:   watch.NoEventCursor,
 			Resource: opts.Resource,
-			Detail:   nil,
+			Detail:   "",
 		}, nil
 	}
 	cut := json.CutJsonDataWithFields(&tailTarget, opts.Fields)
@@ -265,7 +349,7 @@ const (
 // if no events hit, then will loop the event every 200ms until timeout and return
 // with a special cursor named "NoEventCursor", then we will help the user watch
 // event from the head cursor.
-func (s *Service) watchWithCursor(key event.Key, opts *watch.WatchEventOptions, rid string) ([]*watch.WatchEventResp, error) {
+func (s *Service) watchWithCursor(ctx context.Context, key event.Key, opts *watch.WatchEventOptions, rid string) ([]*watch.WatchEventResp, error) {
 	startCursor := opts.Cursor
 	if startCursor == watch.NoEventCursor {
 		// user got no events because of no event occurs in the system in the previous watch around,
@@ -275,21 +359,31 @@ func (s *Service) watchWithCursor(key event.Key, opts *watch.WatchEventOptions,
 
 	start := time.Now().Unix()
 	for {
-		nodes, err := s.getNodesFromCursor(eventStep, startCursor, key)
+		if ctx.Err() != nil {
+			// the client has already disconnected, no point in keeping the
+			// goroutine and its redis pipelines alive.
+			return nil, ctx.Err()
+		}
+
+		metrics.LoopIterationsTotal.WithLabelValues(string(opts.Resource)).Inc()
+
+		nodes, err := s.getNodesFromCursor(ctx, eventStep, startCursor, key)
 		if err != nil {
 			blog.Errorf("watch event from cursor: %s, but get cursors failed, err: %v, rid: %s", opts.Cursor, err, rid)
 			return nil, err
 		}
+		metrics.ChainScanNodes.WithLabelValues(string(opts.Resource)).Observe(float64(len(nodes)))
 
 		if len(nodes) == 0 {
 
 			if time.Now().Unix()-start > timeoutWatchLoopSeconds {
 				// has already looped for timeout seconds, and we still got one event.
 				// return with NoEventCursor and empty detail
+				metrics.TimeoutTotal.WithLabelValues(string(opts.Resource), "no_event").Inc()
 				resp := &watch.WatchEventResp{
 					Cursor:   watch.NoEventCursor,
 					Resource: opts.Resource,
-					Detail:   nil,
+					Detail:   "",
 				}
 
 				// at least the tail node should can be scan, so something goes wrong.
@@ -297,13 +391,17 @@ func (s *Service) watchWithCursor(key event.Key, opts *watch.WatchEventOptions,
 				return []*watch.WatchEventResp{resp}, nil
 			}
 
-			// we got not event one event, sleep a little, and then try to continue the loop watch
-			time.Sleep(loopInternal)
+			// we got not event one event, wait a little, and then try to continue the loop watch,
+			// unless the caller goes away first. backends that can push (etcd)
+			// resolve this as soon as a node lands instead of waiting loopInternal out.
+			if err := s.waitForNextNode(ctx, key, startCursor); err != nil {
+				return nil, err
+			}
 			blog.V(5).Infof("watch key: %s with resource: %s, got nothing, try next round. rid: %s", key.Namespace(), opts.Resource, rid)
 			continue
 		}
 
-		hitNodes := getHitNodeWithEventType(nodes, opts.EventTypes)
+		hitNodes := getHitNodes(nodes, opts)
 		if len(hitNodes) != 0 {
 			// matched event has been found, get them all.
 			blog.V(5).Infof("watch key: %s with resource: %s, hit events, return immediately. rid: %s", key.Namespace(), opts.Resource, rid)
@@ -314,24 +412,68 @@ func (s *Service) watchWithCursor(key event.Key, opts *watch.WatchEventOptions,
 			// no event is hit, but timeout, we return the last event cursor with nil detail
 			// because it's not what the use want, return the last cursor to help user can
 			// watch from here later for next watch round.
+			metrics.TimeoutTotal.WithLabelValues(string(opts.Resource), "no_match").Inc()
 			lastNode := nodes[len(nodes)-1]
 			resp := &watch.WatchEventResp{
 				Cursor:   lastNode.Cursor,
 				Resource: opts.Resource,
-				Detail:   nil,
+				Detail:   "",
 			}
 
 			// at least the tail node should can be scan, so something goes wrong.
 			blog.V(5).Infof("watch with cursor %s, but no event matched in the chain, rid: %s", opts.Cursor, rid)
 			return []*watch.WatchEventResp{resp}, nil
 		}
-		// not event one event is hit, sleep a little, and then try to continue the loop watch
-		time.Sleep(loopInternal)
+		// not event one event is hit, wait a little, and then try to continue the loop watch,
+		// unless the caller goes away first.
+		if err := s.waitForNextNode(ctx, key, startCursor); err != nil {
+			return nil, err
+		}
 		blog.V(5).Infof("watch key: %s with resource: %s, hit nothing, try next round. rid: %s", key.Namespace(), opts.Resource, rid)
 		continue
 	}
 }
 
+// getHitNodes narrows nodes down to the ones matching opts.EventTypes and,
+// of the Filter predicates that are resolvable from a ChainNode's indexed
+// Attrs, the ones in opts.Filter. Predicates that need the full event
+// detail are left for getEventsWithCursorNodes to evaluate after the redis
+// pipeline fetch.
+func getHitNodes(nodes []*watch.ChainNode, opts *watch.WatchEventOptions) []*watch.ChainNode {
+	if len(nodes) == 0 {
+		return nodes
+	}
+
+	hitNodes := getHitNodeWithEventType(nodes, opts.EventTypes)
+	if len(hitNodes) == 0 {
+		return hitNodes
+	}
+
+	nodeLevel, _ := event.SplitPredicates(event.ToPredicates(opts.Filter))
+	if len(nodeLevel) == 0 {
+		return hitNodes
+	}
+
+	filtered := make([]*watch.ChainNode, 0, len(hitNodes))
+	for _, node := range hitNodes {
+		if event.MatchAttrs(nodeLevel, node.Attrs) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// eventsHaveDetail reports whether any of events actually carries a detail,
+// as opposed to being all NoEventCursor/timeout placeholders.
+func eventsHaveDetail(events []*watch.WatchEventResp) bool {
+	for _, ev := range events {
+		if len(ev.Detail) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func getHitNodeWithEventType(nodes []*watch.ChainNode, typs []watch.EventType) []*watch.ChainNode {
 	if len(typs) == 0 {
 		return nodes
@@ -355,4 +497,4 @@ func getHitNodeWithEventType(nodes []*watch.ChainNode, typs []watch.EventType) [
 		}
 	}
 	return hitNodes
-}
\ No newline at end of file
+}
@@ -0,0 +1,358 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	ejson "encoding/json"
+	"net/http"
+	"time"
+
+	"configcenter/src/common"
+	"configcenter/src/common/blog"
+	"configcenter/src/common/metadata"
+	"configcenter/src/common/util"
+	"configcenter/src/common/watch"
+	"configcenter/src/source_controller/coreservice/event"
+	"configcenter/src/source_controller/coreservice/event/metrics"
+	"github.com/emicklei/go-restful"
+	"gopkg.in/redis.v5"
+)
+
+// leaseTTL is how long a durable subscription is kept around without an Ack
+// before it's considered abandoned.
+const leaseTTL = 24 * time.Hour
+
+// leaseScanCount is the COUNT hint passed to every redis SCAN cursor used
+// to enumerate leases, keeping ListLeases from blocking the single redis
+// event loop the way a KEYS scan over every lease would.
+const leaseScanCount = 100
+
+// watchLease is the durable subscription state a client registers so it can
+// resume a watch across reconnects by ClientID alone. LeaseID is generated
+// the first time a client is acked and is unrelated to ClientID, so a
+// caller that presents it on renew/drop fences out a stale instance of the
+// same ClientID that re-registered after losing track of its lease.
+type watchLease struct {
+	ClientID        string            `json:"client_id"`
+	LeaseID         string            `json:"lease_id"`
+	Resource        watch.CursorType  `json:"resource"`
+	EventTypes      []watch.EventType `json:"event_types,omitempty"`
+	Fields          []string          `json:"fields,omitempty"`
+	LastAckedCursor string            `json:"last_acked_cursor"`
+	UpdatedAt       int64             `json:"updated_at"`
+}
+
+// newLeaseID generates a fresh, random LeaseID for a newly registered
+// client subscription.
+func newLeaseID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// leaseKey is the redis key a client's lease is stored under.
+func leaseKey(key event.Key, clientID string) string {
+	return key.Namespace() + ":lease:" + clientID
+}
+
+// scanLeaseKeys enumerates every key matching pattern with SCAN instead of
+// KEYS, so listing leases doesn't block the redis event loop the live
+// long-poll path depends on while it walks the whole keyspace.
+func (s *Service) scanLeaseKeys(pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := s.cache.Scan(cursor, pattern, leaseScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// loadLease reads a client's durable subscription, returning (nil, nil) if
+// none has been registered yet or it has expired off its TTL.
+func (s *Service) loadLease(key event.Key, clientID string) (*watchLease, error) {
+	str, err := s.cache.Get(leaseKey(key, clientID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lease := new(watchLease)
+	if err := ejson.Unmarshal([]byte(str), lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// saveLease persists clientID's subscription state, resetting its TTL.
+func (s *Service) saveLease(key event.Key, lease *watchLease) error {
+	data, err := ejson.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return s.cache.Set(leaseKey(key, lease.ClientID), data, leaseTTL).Err()
+}
+
+// WatchEventAck records that a client has successfully processed events up
+// to cursor, so a later reconnect with the same ClientID resumes from here
+// instead of replaying already handled events.
+func (s *Service) WatchEventAck(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+
+	opts := new(watch.AckOptions)
+	if err := ejson.NewDecoder(req.Request.Body).Decode(opts); err != nil {
+		blog.Errorf("watch event ack, but decode request body failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommJSONUnmarshalFailed)})
+		return
+	}
+
+	key, err := event.GetResourceKeyWithCursorType(opts.Resource)
+	if err != nil {
+		blog.Errorf("watch event ack, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	lease, err := s.loadLease(key, opts.ClientID)
+	if err != nil {
+		blog.Errorf("watch event ack, get lease for client: %s failed, err: %v, rid: %s", opts.ClientID, err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+		return
+	}
+	if lease == nil {
+		leaseID, err := newLeaseID()
+		if err != nil {
+			blog.Errorf("watch event ack, generate lease id for client: %s failed, err: %v, rid: %s", opts.ClientID, err, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+			return
+		}
+		lease = &watchLease{
+			ClientID: opts.ClientID, LeaseID: leaseID, Resource: opts.Resource,
+			EventTypes: opts.EventTypes, Fields: opts.Fields,
+		}
+	}
+	lease.LastAckedCursor = opts.Cursor
+	lease.UpdatedAt = time.Now().Unix()
+
+	if err := s.saveLease(key, lease); err != nil {
+		blog.Errorf("watch event ack, save lease for client: %s failed, err: %v, rid: %s", opts.ClientID, err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+		return
+	}
+
+	resp.WriteEntity(metadata.NewSuccessResp(lease))
+}
+
+// RenewLease resets a lease's TTL without changing its acked cursor, used
+// by long-lived idle clients to signal they're still alive.
+func (s *Service) RenewLease(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+
+	opts := new(watch.LeaseOptions)
+	if err := ejson.NewDecoder(req.Request.Body).Decode(opts); err != nil {
+		blog.Errorf("renew lease, but decode request body failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommJSONUnmarshalFailed)})
+		return
+	}
+
+	key, err := event.GetResourceKeyWithCursorType(opts.Resource)
+	if err != nil {
+		blog.Errorf("renew lease, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	lease, err := s.loadLease(key, opts.ClientID)
+	if err != nil || lease == nil {
+		blog.Errorf("renew lease, no lease registered for client: %s, rid: %s", opts.ClientID, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommNotFound)})
+		return
+	}
+	if len(opts.LeaseID) != 0 && opts.LeaseID != lease.LeaseID {
+		blog.Errorf("renew lease, lease id mismatch for client: %s, rid: %s", opts.ClientID, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommNotFound)})
+		return
+	}
+
+	lease.UpdatedAt = time.Now().Unix()
+	if err := s.saveLease(key, lease); err != nil {
+		blog.Errorf("renew lease for client: %s failed, err: %v, rid: %s", opts.ClientID, err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+		return
+	}
+
+	resp.WriteEntity(metadata.NewSuccessResp(nil))
+}
+
+// DropLease removes a client's durable subscription, e.g. when it's
+// permanently decommissioned and shouldn't show up in ListLeases anymore.
+func (s *Service) DropLease(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+
+	opts := new(watch.LeaseOptions)
+	if err := ejson.NewDecoder(req.Request.Body).Decode(opts); err != nil {
+		blog.Errorf("drop lease, but decode request body failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommJSONUnmarshalFailed)})
+		return
+	}
+
+	key, err := event.GetResourceKeyWithCursorType(opts.Resource)
+	if err != nil {
+		blog.Errorf("drop lease, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	if len(opts.LeaseID) != 0 {
+		lease, err := s.loadLease(key, opts.ClientID)
+		if err != nil || lease == nil {
+			blog.Errorf("drop lease, no lease registered for client: %s, rid: %s", opts.ClientID, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommNotFound)})
+			return
+		}
+		if opts.LeaseID != lease.LeaseID {
+			blog.Errorf("drop lease, lease id mismatch for client: %s, rid: %s", opts.ClientID, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommNotFound)})
+			return
+		}
+	}
+
+	if err := s.cache.Del(leaseKey(key, opts.ClientID)).Err(); err != nil {
+		blog.Errorf("drop lease for client: %s failed, err: %v, rid: %s", opts.ClientID, err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+		return
+	}
+
+	resp.WriteEntity(metadata.NewSuccessResp(nil))
+}
+
+// ListLeases returns every durable subscription currently registered for a
+// resource, for operators to audit stuck or abandoned consumers.
+func (s *Service) ListLeases(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+
+	resource := req.PathParameter("resource")
+	key, err := event.GetResourceKeyWithCursorType(watch.CursorType(resource))
+	if err != nil {
+		blog.Errorf("list leases, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	keys, err := s.scanLeaseKeys(key.Namespace() + ":lease:*")
+	if err != nil {
+		blog.Errorf("list leases for resource: %s failed, err: %v, rid: %s", resource, err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+		return
+	}
+
+	leases := make([]*watchLease, 0, len(keys))
+	for _, k := range keys {
+		str, err := s.cache.Get(k).Result()
+		if err != nil {
+			continue
+		}
+		lease := new(watchLease)
+		if err := ejson.Unmarshal([]byte(str), lease); err != nil {
+			continue
+		}
+		leases = append(leases, lease)
+	}
+
+	resp.WriteEntity(metadata.NewSuccessResp(leases))
+}
+
+// resumeFromLease resolves a ClientID-only watch request to a starting
+// cursor. A gap exists when the acked cursor's own event is now older than
+// the oldest event still in the chain, i.e. it has rotated out past the
+// chain's TTL window - not when the client happened to call /ack a while
+// ago, since a client that acks "now" after replaying an old backlog would
+// otherwise wrongly pass a wall-clock check and resume from a cursor that's
+// already gone. When gapDetected is true, the caller should trigger a full
+// resync instead of trusting the returned head cursor.
+func (s *Service) resumeFromLease(key event.Key, clientID string, rid string) (cursor string, gapDetected bool, err error) {
+	lease, err := s.loadLease(key, clientID)
+	if err != nil {
+		return "", false, err
+	}
+	if lease == nil || len(lease.LastAckedCursor) == 0 {
+		return key.HeadKey(), false, nil
+	}
+
+	headTarget, _, err := s.getHeadTailNodeTargetNode(key)
+	if err != nil {
+		blog.Errorf("resume from lease, get head target node failed, err: %v, rid: %s", err, rid)
+		return "", false, err
+	}
+	if headTarget.NextCursor == key.TailKey() {
+		// the chain is empty, nothing has rotated out from under the lease.
+		return lease.LastAckedCursor, false, nil
+	}
+
+	store, err := s.getStore(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	ackedNode, err := store.GetNode(key, lease.LastAckedCursor)
+	if err != nil {
+		// the acked cursor's own node has already rotated out of the
+		// chain, there's no way left to tell how far behind it fell.
+		blog.Errorf("resume from lease, acked cursor: %s no longer in chain, err: %v, rid: %s", lease.LastAckedCursor, err, rid)
+		metrics.GapDetectedTotal.WithLabelValues(string(lease.Resource)).Inc()
+		return key.HeadKey(), true, nil
+	}
+
+	headNode, err := store.GetNode(key, headTarget.NextCursor)
+	if err != nil {
+		blog.Errorf("resume from lease, get chain head node failed, err: %v, rid: %s", err, rid)
+		return "", false, err
+	}
+
+	if leaseHasGap(ackedNode.ClusterTime.Sec, headNode.ClusterTime.Sec) {
+		// the acked cursor's own event predates the oldest event still in
+		// the chain, it has rotated out past the TTL window.
+		metrics.GapDetectedTotal.WithLabelValues(string(lease.Resource)).Inc()
+		return key.HeadKey(), true, nil
+	}
+
+	return lease.LastAckedCursor, false, nil
+}
+
+// leaseHasGap reports whether an acked cursor's own event time is older
+// than the oldest event time still present in the chain, i.e. whether it
+// has rotated out past the chain's TTL window since it was last acked.
+func leaseHasGap(ackedSec, headSec uint32) bool {
+	return ackedSec < headSec
+}
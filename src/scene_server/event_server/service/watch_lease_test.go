@@ -0,0 +1,54 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import "testing"
+
+func TestLeaseHasGap(t *testing.T) {
+	cases := []struct {
+		name    string
+		acked   uint32
+		head    uint32
+		wantGap bool
+	}{
+		{name: "acked event newer than chain head", acked: 200, head: 100, wantGap: false},
+		{name: "acked event same second as chain head", acked: 100, head: 100, wantGap: false},
+		{name: "acked event rotated out past chain head", acked: 50, head: 100, wantGap: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := leaseHasGap(c.acked, c.head); got != c.wantGap {
+				t.Errorf("leaseHasGap(%d, %d) = %v, want %v", c.acked, c.head, got, c.wantGap)
+			}
+		})
+	}
+}
+
+func TestNewLeaseID(t *testing.T) {
+	a, err := newLeaseID()
+	if err != nil {
+		t.Fatalf("newLeaseID() returned error: %v", err)
+	}
+	if len(a) == 0 {
+		t.Fatal("newLeaseID() returned an empty id")
+	}
+
+	b, err := newLeaseID()
+	if err != nil {
+		t.Fatalf("newLeaseID() returned error: %v", err)
+	}
+	if a == b {
+		t.Fatalf("newLeaseID() returned the same id twice: %s", a)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	ejson "encoding/json"
+	"net/http"
+	"time"
+
+	"configcenter/src/common"
+	"configcenter/src/common/blog"
+	"configcenter/src/common/metadata"
+	"configcenter/src/common/util"
+	"configcenter/src/common/watch"
+	"configcenter/src/source_controller/coreservice/event"
+	"configcenter/src/source_controller/coreservice/event/metrics"
+	"github.com/emicklei/go-restful"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// multiWatchTimeout is the shared deadline every fanned-out per-resource
+// watch in a single WatchMultiEvent request is held to, the same 25s a
+// single WatchEvent long-poll already uses.
+const multiWatchTimeout = 25 * time.Second
+
+// MultiWatchEventOptions is the body of POST /watch/multi: one
+// WatchEventOptions per resource to watch, each carrying its own Resource,
+// cursor/start_from, event_types and fields.
+type MultiWatchEventOptions struct {
+	Requests []watch.WatchEventOptions `json:"requests"`
+	// MinWaitMs lets a throughput-sensitive caller ask to hold the response
+	// open a little longer after the first resource hits, so events from
+	// other resources that are close behind can be batched into the same
+	// round trip instead of triggering a second request.
+	MinWaitMs int64 `json:"min_wait_ms,omitempty"`
+}
+
+// multiWatchResult is one resource's outcome from a fanned-out watch.
+type multiWatchResult struct {
+	resource watch.CursorType
+	events   []*watch.WatchEventResp
+	err      error
+}
+
+// WatchMultiEvent watches several resources in a single request, fanning
+// out into one goroutine per resource under a shared deadline instead of
+// making the caller open one long-poll per resource. As soon as any
+// resource produces a non-empty result the sibling waits are cancelled and
+// the response is returned, unless MinWaitMs asks to batch a little
+// longer first - the same "first responder wins, but give stragglers a
+// short grace window" shape as Kubernetes informer multiplexing.
+func (s *Service) WatchMultiEvent(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+	ctx, span := tracer.Start(req.Request.Context(), "WatchMultiEvent")
+	defer span.End()
+
+	body := new(MultiWatchEventOptions)
+	if err := ejson.NewDecoder(req.Request.Body).Decode(body); err != nil {
+		blog.Errorf("watch multi event, but decode request body failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommJSONUnmarshalFailed)})
+		return
+	}
+
+	if len(body.Requests) == 0 {
+		blog.Errorf("watch multi event, but got no requests, rid: %s", rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	keys := make([]event.Key, len(body.Requests))
+	for idx := range body.Requests {
+		opts := &body.Requests[idx]
+		if err := opts.Validate(); err != nil {
+			blog.Errorf("watch multi event, resource: %s, invalid options, err: %v, rid: %s", opts.Resource, err, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+			return
+		}
+
+		key, err := event.GetResourceKeyWithCursorType(opts.Resource)
+		if err != nil {
+			blog.Errorf("watch multi event, resource: %s, get resource key failed, err: %v, rid: %s", opts.Resource, err, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+			return
+		}
+		keys[idx] = key
+	}
+
+	span.SetAttributes(attribute.Int("request_count", len(body.Requests)))
+
+	watchCtx, cancel := context.WithTimeout(ctx, multiWatchTimeout)
+	defer cancel()
+
+	// buffered so a goroutine whose result we stop waiting for can still
+	// send without leaking.
+	results := make(chan multiWatchResult, len(body.Requests))
+	for idx := range body.Requests {
+		go func(key event.Key, opts *watch.WatchEventOptions) {
+			results <- s.watchOneOfMulti(watchCtx, key, opts, rid)
+		}(keys[idx], &body.Requests[idx])
+	}
+
+	var batchDeadline <-chan time.Time
+
+	merged := make(map[watch.CursorType][]*watch.WatchEventResp, len(body.Requests))
+	remaining := len(body.Requests)
+	for remaining > 0 {
+		select {
+		case r := <-results:
+			remaining--
+			if r.err != nil {
+				continue
+			}
+			merged[r.resource] = r.events
+			if batchDeadline == nil && eventsHaveDetail(r.events) {
+				if wait := batchWait(body.MinWaitMs); wait <= 0 {
+					cancel()
+				} else {
+					batchDeadline = time.After(wait)
+				}
+			}
+
+		case <-batchDeadline:
+			// at least one resource hit and the grace window to batch more
+			// along with it has passed, stop waiting for the rest.
+			cancel()
+			batchDeadline = nil
+
+		case <-watchCtx.Done():
+			remaining = 0
+		}
+	}
+
+	span.SetAttributes(attribute.Int("resource_count", len(merged)))
+	resp.WriteEntity(merged)
+}
+
+// batchWait returns how long WatchMultiEvent should keep waiting for other
+// resources to batch into the same response after the first one produces a
+// hit, given the request's MinWaitMs. Zero means cancel the remaining
+// fanned-out watches immediately instead of waiting.
+func batchWait(minWaitMs int64) time.Duration {
+	if minWaitMs <= 0 {
+		return 0
+	}
+	return time.Duration(minWaitMs) * time.Millisecond
+}
+
+// watchOneOfMulti runs a single resource's share of a WatchMultiEvent
+// request through the same helpers a standalone WatchEvent call would use.
+func (s *Service) watchOneOfMulti(ctx context.Context, key event.Key, opts *watch.WatchEventOptions, rid string) multiWatchResult {
+	metrics.ActiveClients.WithLabelValues(string(opts.Resource)).Inc()
+	defer metrics.ActiveClients.WithLabelValues(string(opts.Resource)).Dec()
+
+	var gapDetected bool
+	if len(opts.Cursor) == 0 && opts.StartFrom == 0 && len(opts.ClientID) != 0 {
+		cursor, gap, err := s.resumeFromLease(key, opts.ClientID, rid)
+		if err != nil {
+			blog.Errorf("watch multi event, resource: %s, resume from lease for client: %s failed, err: %v, rid: %s",
+				opts.Resource, opts.ClientID, err, rid)
+			return multiWatchResult{resource: opts.Resource, err: err}
+		}
+		opts.Cursor = cursor
+		gapDetected = gap
+	}
+
+	var events []*watch.WatchEventResp
+	var err error
+	switch {
+	case len(opts.Cursor) != 0:
+		events, err = s.watchWithCursor(ctx, key, opts, rid)
+	case opts.StartFrom != 0:
+		events, err = s.watchWithStartFrom(ctx, key, opts, rid)
+	default:
+		var ev *watch.WatchEventResp
+		ev, err = s.watchFromNow(key, opts, rid)
+		if err == nil {
+			events = []*watch.WatchEventResp{ev}
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		// the shared deadline expired, or a sibling already hit and we were
+		// cancelled mid-wait - not a real error worth surfacing.
+		return multiWatchResult{resource: opts.Resource, err: nil}
+	}
+	if err != nil {
+		blog.Errorf("watch multi event, resource: %s, err: %v, rid: %s", opts.Resource, err, rid)
+	}
+	if gapDetected && len(events) != 0 {
+		events[0].GapDetected = true
+	}
+	return multiWatchResult{resource: opts.Resource, events: events, err: err}
+}
@@ -0,0 +1,71 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"configcenter/src/common/watch"
+)
+
+func TestBatchWait(t *testing.T) {
+	cases := []struct {
+		name      string
+		minWaitMs int64
+		want      time.Duration
+	}{
+		{name: "unset means cancel immediately", minWaitMs: 0, want: 0},
+		{name: "negative means cancel immediately", minWaitMs: -1, want: 0},
+		{name: "positive waits that long", minWaitMs: 50, want: 50 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := batchWait(c.minWaitMs); got != c.want {
+				t.Errorf("batchWait(%d) = %v, want %v", c.minWaitMs, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEventsHaveDetail(t *testing.T) {
+	cases := []struct {
+		name   string
+		events []*watch.WatchEventResp
+		want   bool
+	}{
+		{name: "empty", events: nil, want: false},
+		{
+			name:   "all placeholders",
+			events: []*watch.WatchEventResp{{Cursor: watch.NoEventCursor}},
+			want:   false,
+		},
+		{
+			name: "one real detail",
+			events: []*watch.WatchEventResp{
+				{Cursor: watch.NoEventCursor},
+				{Cursor: "2", Detail: watch.JsonString(`{"bk_biz_id":2}`)},
+			},
+			want: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := eventsHaveDetail(c.events); got != c.want {
+				t.Errorf("eventsHaveDetail() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
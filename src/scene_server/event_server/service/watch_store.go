@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"configcenter/src/common/watch"
+	"configcenter/src/source_controller/coreservice/event"
+)
+
+// eventStep bounds how many cursor-chain nodes a single scan round reads,
+// the unit watchWithCursor and watchWithStartFrom advance the chain by on
+// every loop iteration.
+const eventStep = 200
+
+// wireRedisStoreOnce wires this Service's existing redis client into the
+// event package the first time a Store is requested, so the redis backed
+// Store implementation has a client to use without requiring its own
+// startup wiring step in every binary that constructs a Service.
+var wireRedisStoreOnce sync.Once
+
+// getStore resolves the configured Store backend for key, the single choke
+// point every chain read and write in this package goes through so
+// swapping StoreTypeRedis for StoreTypeEtcd doesn't require touching the
+// watch handlers at all.
+func (s *Service) getStore(key event.Key) (event.Store, error) {
+	wireRedisStoreOnce.Do(func() {
+		event.SetRedisClient(s.cache)
+	})
+	return event.NewConfiguredStore(key)
+}
+
+// getHeadTailNodeTargetNode returns key's chain head and tail target nodes.
+func (s *Service) getHeadTailNodeTargetNode(key event.Key) (head, tail *watch.ChainNode, err error) {
+	store, err := s.getStore(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetHeadTail(key)
+}
+
+// getNodesFromCursor scans up to step chain nodes forward from cursor
+// through key's configured Store, bailing out immediately if the caller
+// has already gone away instead of paying for the round trip.
+func (s *Service) getNodesFromCursor(ctx context.Context, step int, cursor string, key event.Key) ([]*watch.ChainNode, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	store, err := s.getStore(key)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetNodesFromCursor(step, cursor, key)
+}
+
+// waitForNextNode blocks until key's chain has a node past cursor, ctx is
+// cancelled, or loopInternal elapses, whichever comes first. A backend
+// that can push (etcd's Store.Watch) resolves as soon as a node lands
+// instead of waiting out the full interval the way a backend with no such
+// mechanism (redis) has to.
+func (s *Service) waitForNextNode(ctx context.Context, key event.Key, cursor string) error {
+	store, err := s.getStore(key)
+	if err != nil {
+		return err
+	}
+
+	if ch, ok := store.Watch(ctx, key, cursor); ok {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+			return nil
+		case <-time.After(loopInternal):
+			return nil
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(loopInternal):
+		return nil
+	}
+}
+
+// getLatestEventDetail returns key's newest chain node together with its
+// event detail, the pair watchFromNow needs to answer a "from now" watch.
+func (s *Service) getLatestEventDetail(key event.Key) (node *watch.ChainNode, detail string, err error) {
+	store, err := s.getStore(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, tail, err := store.GetHeadTail(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if tail.NextCursor == key.HeadKey() {
+		// the tail sentinel still points back at the head, nothing has
+		// ever been written for this resource.
+		return &watch.ChainNode{Cursor: watch.NoEventCursor}, "", nil
+	}
+
+	node, err = store.GetNode(key, tail.NextCursor)
+	if err != nil {
+		return nil, "", err
+	}
+	detail, err = store.GetDetail(key, node.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	return node, detail, nil
+}
@@ -0,0 +1,192 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	ejson "encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"configcenter/src/common"
+	"configcenter/src/common/blog"
+	"configcenter/src/common/metadata"
+	"configcenter/src/common/util"
+	"configcenter/src/common/watch"
+	"configcenter/src/source_controller/coreservice/event"
+	"configcenter/src/source_controller/coreservice/event/metrics"
+	"github.com/emicklei/go-restful"
+)
+
+// keepAliveInterval is how often a comment frame is sent on an otherwise
+// idle SSE stream so intermediate proxies don't time the connection out.
+const keepAliveInterval = 15 * time.Second
+
+// streamSendBuffer bounds how many un-flushed event batches can be queued
+// for a single SSE client before it's considered too slow and resynced.
+const streamSendBuffer = 64
+
+// WatchEventStream upgrades the request to a Server-Sent Events stream and
+// pushes WatchEventResp frames as soon as the cursor chain advances,
+// replacing repeated 25s long-polls with one connection held open for as
+// long as the client stays connected.
+func (s *Service) WatchEventStream(req *restful.Request, resp *restful.Response) {
+	header := req.Request.Header
+	rid := util.GetHTTPCCRequestID(header)
+	defErr := s.CCErr.CreateDefaultCCErrorIf(util.GetLanguage(header))
+	ctx, span := tracer.Start(req.Request.Context(), "WatchEventStream")
+	defer span.End()
+
+	resource := req.PathParameter("resource")
+	options := new(watch.WatchEventOptions)
+	if err := ejson.NewDecoder(req.Request.Body).Decode(options); err != nil {
+		blog.Errorf("watch event stream, but decode request body failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommJSONUnmarshalFailed)})
+		return
+	}
+	options.Resource = watch.CursorType(resource)
+
+	if err := options.Validate(); err != nil {
+		blog.Errorf("watch event stream, but got invalid request options, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	key, err := event.GetResourceKeyWithCursorType(options.Resource)
+	if err != nil {
+		blog.Errorf("watch event stream, but get resource key with cursor type failed, err: %v, rid: %s", err, rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPInputInvalid)})
+		return
+	}
+
+	metrics.ActiveClients.WithLabelValues(string(options.Resource)).Inc()
+	defer metrics.ActiveClients.WithLabelValues(string(options.Resource)).Dec()
+
+	flusher, ok := resp.ResponseWriter.(http.Flusher)
+	if !ok {
+		blog.Errorf("watch event stream, but response writer does not support flush, rid: %s", rid)
+		resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommHTTPDoRequestFailed)})
+		return
+	}
+
+	w := resp.ResponseWriter
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	cursor := options.Cursor
+	var gapDetected bool
+	if len(cursor) == 0 && options.StartFrom == 0 && len(options.ClientID) != 0 {
+		resumed, gap, err := s.resumeFromLease(key, options.ClientID, rid)
+		if err != nil {
+			blog.Errorf("watch event stream, resume from lease for client: %s failed, err: %v, rid: %s", options.ClientID, err, rid)
+			resp.WriteError(http.StatusOK, &metadata.RespError{Msg: defErr.Error(common.CCErrCommDBSelectFailed)})
+			return
+		}
+		cursor = resumed
+		gapDetected = gap
+	}
+	if len(cursor) == 0 {
+		cursor = key.HeadKey()
+	}
+
+	send := make(chan []*watch.WatchEventResp, streamSendBuffer)
+	go s.pumpWatchStream(ctx, key, options, cursor, gapDetected, send, rid)
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			blog.V(5).Infof("watch event stream, client disconnected, resource: %s, rid: %s", resource, rid)
+			return
+
+		case events, ok := <-send:
+			if !ok {
+				return
+			}
+			for _, ev := range events {
+				data, err := ejson.Marshal(ev)
+				if err != nil {
+					blog.Errorf("watch event stream, marshal event failed, err: %v, rid: %s", err, rid)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Resource, data)
+			}
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			// a comment frame, ignored by every SSE client, keeps
+			// intermediaries from closing the connection as idle.
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// pumpWatchStream repeatedly calls watchWithCursor and forwards whatever it
+// returns onto send, advancing cursor as events are produced. If send fills
+// up because the client can't keep up, the slowest consumer is dropped back
+// to resync from the chain's head instead of blocking the scan forever.
+func (s *Service) pumpWatchStream(ctx context.Context, key event.Key, opts *watch.WatchEventOptions, cursor string,
+	gapDetected bool, send chan<- []*watch.WatchEventResp, rid string) {
+	defer close(send)
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		roundOpts := *opts
+		roundOpts.Cursor = cursor
+		events, err := s.watchWithCursor(ctx, key, &roundOpts, rid)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			blog.Errorf("watch event stream, pump round failed, cursor: %s, err: %v, rid: %s", cursor, err, rid)
+			return
+		}
+
+		if len(events) == 0 {
+			continue
+		}
+
+		last := events[len(events)-1]
+		if last.Cursor != watch.NoEventCursor {
+			cursor = last.Cursor
+		}
+
+		if !eventsHaveDetail(events) {
+			continue
+		}
+
+		if gapDetected {
+			events[0].GapDetected = true
+			gapDetected = false
+		}
+
+		select {
+		case send <- events:
+		default:
+			// the consumer fell behind, drop this batch and resync from the
+			// chain head on the next round rather than backing up forever.
+			blog.Errorf("watch event stream, client too slow, resync from head, resource: %s, rid: %s", opts.Resource, rid)
+			cursor = key.HeadKey()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+// configuredStoreType is the backend recorded by SetStoreType; no
+// configuration file option is read into it, and nothing in this repository
+// calls SetStoreType. Left unset (the zero value) it's not
+// treated as "redis" directly - see NewConfiguredStore - so that wiring an
+// etcd client via SetEtcdClient is, on its own, enough to switch the
+// backend over without also requiring a separate SetStoreType("etcd")
+// call that's easy to leave out of a startup path.
+var configuredStoreType StoreType
+
+// SetStoreType records which backend coreservice was configured to use,
+// overriding the backend NewConfiguredStore would otherwise infer from
+// which client(s) have been wired. Call once during startup, before the
+// first NewStore call, only when the default inference isn't enough, e.g.
+// running with both clients wired but wanting to stay on redis.
+func SetStoreType(typ StoreType) {
+	if typ == "" {
+		return
+	}
+	configuredStoreType = typ
+}
+
+// NewConfiguredStore builds a Store for key using the backend SetStoreType
+// selected, or, if that was never called, etcd if SetEtcdClient has been
+// wired and redis otherwise - so a deployment that only ever calls
+// SetEtcdClient at startup still gets the etcd backend it asked for.
+func NewConfiguredStore(key Key) (Store, error) {
+	typ := configuredStoreType
+	if typ == "" {
+		typ = StoreTypeRedis
+		if globalEtcdClient != nil {
+			typ = StoreTypeEtcd
+		}
+	}
+	return NewStore(typ, key)
+}
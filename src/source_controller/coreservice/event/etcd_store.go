@@ -0,0 +1,378 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"context"
+	ejson "encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"configcenter/src/common/blog"
+	"configcenter/src/common/json"
+	"configcenter/src/common/watch"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// etcdNodeRecord is the on-the-wire shape a chain node and the event detail
+// it represents are stored together as, under a single etcd key, so a
+// single Get returns everything GetNodesFromCursor/GetDetail need without a
+// second round trip.
+type etcdNodeRecord struct {
+	watch.ChainNode
+	Detail ejson.RawMessage `json:"detail"`
+}
+
+// watchChanBuffer bounds how many chain nodes can be buffered between the
+// etcd watch goroutine and its consumer before the consumer blocks.
+const watchChanBuffer = 100
+
+// etcdStore keeps the cursor chain and event details in etcd v3. A chain
+// node's cursor is the decimal string of the etcd ModRevision that created
+// it, so resuming from a cursor is just a range-get starting right after
+// that revision, and new events can be observed with a single long lived
+// clientv3.Watch instead of the 250ms busy-poll the redis backend needs.
+type etcdStore struct {
+	client *clientv3.Client
+	key    Key
+}
+
+// globalEtcdClient is the client SetEtcdClient wired; while it's nil,
+// NewConfiguredStore picks redis unless SetStoreType chose otherwise.
+var globalEtcdClient *clientv3.Client
+
+// SetEtcdClient wires the shared etcd v3 client into the event package.
+// Nothing in this repository calls it, so the etcd backend stays unused
+// until a startup path does.
+func SetEtcdClient(client *clientv3.Client) {
+	globalEtcdClient = client
+}
+
+func newEtcdStore(key Key) (Store, error) {
+	return &etcdStore{
+		client: globalEtcdClient,
+		key:    key,
+	}, nil
+}
+
+func (s *etcdStore) Namespace() string {
+	return s.key.Namespace()
+}
+
+func (s *etcdStore) TTL() int64 {
+	return s.key.TTLSeconds()
+}
+
+// prefix is the etcd key prefix everything belonging to this resource -
+// chain nodes, the time index and the PushNode staging key - is written
+// under.
+func (s *etcdStore) prefix() string {
+	return s.key.Namespace() + "/"
+}
+
+// nodePrefix is where chain node records (an etcdNodeRecord, keyed by
+// cursor) live. It must be its own sub-prefix, distinct from the time
+// index and staging key below, because GetHeadTail/GetNodesFromCursor/
+// Watch all range-scan it with WithPrefix and unmarshal every key they
+// see as an etcdNodeRecord - a time index entry or a leftover staging key
+// under the same flat prefix would be scanned right along with them and
+// fail to unmarshal.
+func (s *etcdStore) nodePrefix() string {
+	return s.prefix() + "node/"
+}
+
+func (s *etcdStore) detailKey(cursor string) string {
+	return s.nodePrefix() + cursor
+}
+
+// stagingKey is PushNode's throwaway write target, used only to learn the
+// ModRevision a Put is assigned before promoting it to its real cursor key.
+func (s *etcdStore) stagingKey() string {
+	return s.prefix() + "staging"
+}
+
+// cursorToRevision parses a cursor produced by this backend back into the
+// etcd ModRevision it was derived from.
+func cursorToRevision(cursor string) (int64, error) {
+	return strconv.ParseInt(cursor, 10, 64)
+}
+
+// revisionToCursor turns an etcd ModRevision into the cursor string handed
+// back to watch clients.
+func revisionToCursor(rev int64) string {
+	return strconv.FormatInt(rev, 10)
+}
+
+func (s *etcdStore) GetHeadTail(key Key) (head, tail *watch.ChainNode, err error) {
+	ctx := context.Background()
+	first, err := s.client.Get(ctx, s.nodePrefix(), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend), clientv3.WithLimit(1))
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := s.client.Get(ctx, s.nodePrefix(), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend), clientv3.WithLimit(1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	head = &watch.ChainNode{Cursor: key.HeadKey(), NextCursor: key.TailKey()}
+	tail = &watch.ChainNode{Cursor: key.TailKey(), NextCursor: key.HeadKey()}
+	if len(first.Kvs) != 0 {
+		head.NextCursor = revisionToCursor(first.Kvs[0].ModRevision)
+	}
+	if len(last.Kvs) != 0 {
+		tail.NextCursor = revisionToCursor(last.Kvs[0].ModRevision)
+	}
+	return head, tail, nil
+}
+
+// GetNodesFromCursor scans forward from the revision right after the one
+// cursor points at, returning up to step nodes in ModRevision order. It
+// uses no index; StartFrom is translated into a cursor by ResolveStartFrom.
+func (s *etcdStore) GetNodesFromCursor(step int, cursor string, key Key) ([]*watch.ChainNode, error) {
+	startRev := int64(0)
+	if cursor != key.HeadKey() {
+		rev, err := cursorToRevision(cursor)
+		if err != nil {
+			return nil, err
+		}
+		startRev = rev + 1
+	}
+
+	resp, err := s.client.Get(context.Background(), s.nodePrefix(), clientv3.WithPrefix(),
+		clientv3.WithMinModRev(startRev), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend),
+		clientv3.WithLimit(int64(step)))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*watch.ChainNode, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		record := new(etcdNodeRecord)
+		if err := json.Unmarshal(kv.Value, record); err != nil {
+			return nil, err
+		}
+		record.Cursor = revisionToCursor(kv.ModRevision)
+		nodes = append(nodes, &record.ChainNode)
+	}
+	return nodes, nil
+}
+
+// GetNode fetches a single chain node's metadata by cursor.
+func (s *etcdStore) GetNode(key Key, cursor string) (*watch.ChainNode, error) {
+	resp, err := s.client.Get(context.Background(), s.detailKey(cursor))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.New("chain node not found: " + cursor)
+	}
+
+	record := new(etcdNodeRecord)
+	if err := json.Unmarshal(resp.Kvs[0].Value, record); err != nil {
+		return nil, err
+	}
+	record.Cursor = cursor
+	return &record.ChainNode, nil
+}
+
+func (s *etcdStore) GetDetail(key Key, cursor string) (string, error) {
+	resp, err := s.client.Get(context.Background(), s.detailKey(cursor))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+
+	record := new(etcdNodeRecord)
+	if err := json.Unmarshal(resp.Kvs[0].Value, record); err != nil {
+		return "", err
+	}
+	return string(record.Detail), nil
+}
+
+func (s *etcdStore) PipelineGetDetails(key Key, cursors []string) ([]string, error) {
+	ops := make([]clientv3.Op, len(cursors))
+	for idx, cursor := range cursors {
+		ops[idx] = clientv3.OpGet(s.detailKey(cursor))
+	}
+
+	txn := s.client.Txn(context.Background()).Then(ops...)
+	resp, err := txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	details := make([]string, len(cursors))
+	for idx, r := range resp.Responses {
+		getResp := r.GetResponseRange()
+		if getResp == nil || len(getResp.Kvs) == 0 {
+			continue
+		}
+		record := new(etcdNodeRecord)
+		if err := json.Unmarshal(getResp.Kvs[0].Value, record); err != nil {
+			return nil, err
+		}
+		details[idx] = string(record.Detail)
+	}
+	return details, nil
+}
+
+// timeIndexPrefix is the sub-prefix time-index entries are written under,
+// kept separate from nodePrefix so a GetNodesFromCursor/Watch scan of the
+// chain never has to skip over them.
+func (s *etcdStore) timeIndexPrefix() string {
+	return s.prefix() + "tidx/"
+}
+
+// timeIndexKey is where the cursor of the earliest event seen at sec is
+// recorded, maintained by PushNode so ResolveStartFrom can jump straight to
+// the right neighbourhood of the chain instead of scanning from the head.
+func (s *etcdStore) timeIndexKey(sec int64) string {
+	return s.timeIndexPrefix() + fmt.Sprintf("%020d", sec)
+}
+
+// ResolveStartFrom finds the earliest recorded cursor at or after startFrom
+// by range-scanning the time index PushNode maintains.
+func (s *etcdStore) ResolveStartFrom(key Key, startFrom int64) (string, bool, error) {
+	from := s.timeIndexKey(startFrom)
+	to := s.prefix() + "tidx0"
+	// "tidx0" sorts right after every "tidx/..." key, so this range covers
+	// exactly the time index and nothing from nodePrefix or the staging key.
+	resp, err := s.client.Get(context.Background(), from, clientv3.WithRange(to),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend), clientv3.WithLimit(1))
+	if err != nil {
+		return "", false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(resp.Kvs[0].Value), true, nil
+}
+
+// PushNode writes a new event as the chain's latest node: its record at
+// detailKey(cursor), keyed by the etcd ModRevision the Put is assigned, and
+// a time-index entry for its creation second if one isn't already recorded.
+func (s *etcdStore) PushNode(key Key, eventType watch.EventType, detail map[string]interface{}) (*watch.ChainNode, error) {
+	detailData, err := ejson.Marshal(detail)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	node := watch.ChainNode{
+		ClusterTime: watch.TimeStamp{Sec: uint32(now.Unix())},
+		EventType:   eventType,
+		Attrs:       buildChainNodeAttrs(detail),
+	}
+	record := etcdNodeRecord{ChainNode: node, Detail: detailData}
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cursor is the revision this Put is assigned, which we only learn
+	// from the response, so the key it's written under has to be
+	// content-addressed by something else: a local sequence number scoped
+	// to this process would race across coreservice replicas, so instead
+	// write under a throwaway staging key and learn the real ModRevision
+	// from the Put response, then promote it under its cursor key.
+	staging := s.stagingKey()
+	putResp, err := s.client.Put(context.Background(), staging, string(recordData))
+	if err != nil {
+		return nil, err
+	}
+	cursor := revisionToCursor(putResp.Header.Revision)
+
+	if _, err := s.client.Put(context.Background(), s.detailKey(cursor), string(recordData)); err != nil {
+		return nil, err
+	}
+	if _, err := s.client.Delete(context.Background(), staging); err != nil {
+		return nil, err
+	}
+
+	idxKey := s.timeIndexKey(int64(node.ClusterTime.Sec))
+	idxTxn := s.client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(idxKey), "=", 0)).
+		Then(clientv3.OpPut(idxKey, cursor))
+	if _, err := idxTxn.Commit(); err != nil {
+		return nil, err
+	}
+
+	node.Cursor = cursor
+	return &node, nil
+}
+
+// Watch blocks the watch service's long-poll loop on a single long lived
+// etcd watch starting right after cursor instead of the redis backend's
+// loopInternal busy-poll. ok is false only when cursor can't be parsed as
+// a revision.
+func (s *etcdStore) Watch(ctx context.Context, key Key, cursor string) (<-chan *watch.ChainNode, bool) {
+	startRev := int64(0)
+	if cursor != key.HeadKey() && len(cursor) != 0 {
+		rev, err := cursorToRevision(cursor)
+		if err != nil {
+			blog.Errorf("etcd store watch on namespace %s, parse cursor %s as revision failed, err: %v",
+				s.Namespace(), cursor, err)
+			return nil, false
+		}
+		startRev = rev + 1
+	}
+	return s.watchFromRevision(ctx, startRev), true
+}
+
+// watchFromRevision streams chain nodes created at or after startRevision
+// until ctx is cancelled.
+func (s *etcdStore) watchFromRevision(ctx context.Context, startRevision int64) <-chan *watch.ChainNode {
+	out := make(chan *watch.ChainNode, watchChanBuffer)
+	watchChan := s.client.Watch(ctx, s.nodePrefix(), clientv3.WithPrefix(), clientv3.WithRev(startRevision))
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case wresp, ok := <-watchChan:
+				if !ok {
+					return
+				}
+				if wresp.Err() != nil {
+					blog.Errorf("etcd store watch on namespace %s failed, err: %v", s.Namespace(), wresp.Err())
+					return
+				}
+				for _, ev := range wresp.Events {
+					if !strings.HasPrefix(string(ev.Kv.Key), s.nodePrefix()) {
+						continue
+					}
+					node := new(watch.ChainNode)
+					if err := json.Unmarshal(ev.Kv.Value, node); err != nil {
+						blog.Errorf("etcd store watch on namespace %s, unmarshal chain node failed, err: %v", s.Namespace(), err)
+						continue
+					}
+					node.Cursor = revisionToCursor(ev.Kv.ModRevision)
+					select {
+					case out <- node:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return out
+}
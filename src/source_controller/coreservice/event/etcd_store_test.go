@@ -0,0 +1,83 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeKey is a minimal Key good enough to exercise etcdStore's key-building
+// helpers without a real watchable resource.
+type fakeKey struct{}
+
+func (fakeKey) Namespace() string              { return "watch:test" }
+func (fakeKey) HeadKey() string                { return "head" }
+func (fakeKey) TailKey() string                { return "tail" }
+func (fakeKey) DetailKey(cursor string) string { return "watch:test:detail:" + cursor }
+func (fakeKey) TTLSeconds() int64              { return 3600 }
+
+// TestEtcdStoreSubPrefixesDoNotCollide guards against the nodePrefix/
+// timeIndexPrefix/stagingKey sub-prefixes ever overlapping again: a
+// GetNodesFromCursor/GetHeadTail/Watch range scan over nodePrefix must
+// never also match a time-index or staging key, or it'll try to unmarshal
+// them as an etcdNodeRecord and blow up the whole scan.
+func TestEtcdStoreSubPrefixesDoNotCollide(t *testing.T) {
+	s := &etcdStore{key: fakeKey{}}
+
+	node := s.detailKey("123")
+	idx := s.timeIndexKey(123)
+	staging := s.stagingKey()
+
+	for _, other := range []string{idx, staging} {
+		if strings.HasPrefix(other, s.nodePrefix()) {
+			t.Fatalf("nodePrefix() = %q unexpectedly matches %q", s.nodePrefix(), other)
+		}
+	}
+	if !strings.HasPrefix(node, s.nodePrefix()) {
+		t.Fatalf("detailKey() = %q is not under nodePrefix() = %q", node, s.nodePrefix())
+	}
+	if !strings.HasPrefix(idx, s.timeIndexPrefix()) {
+		t.Fatalf("timeIndexKey() = %q is not under timeIndexPrefix() = %q", idx, s.timeIndexPrefix())
+	}
+}
+
+// TestResolveStartFromRangeExcludesOtherSubPrefixes guards the lexical
+// range ResolveStartFrom scans ([tidx/<sec>, tidx0)) against ever again
+// capturing a node or staging key that happens to sort inside it.
+func TestResolveStartFromRangeExcludesOtherSubPrefixes(t *testing.T) {
+	s := &etcdStore{key: fakeKey{}}
+
+	from := s.timeIndexKey(0)
+	to := s.prefix() + "tidx0"
+
+	for _, other := range []string{s.detailKey("123"), s.stagingKey()} {
+		if other >= from && other < to {
+			t.Fatalf("key %q unexpectedly falls inside the time-index scan range [%q, %q)", other, from, to)
+		}
+	}
+}
+
+func TestCursorRevisionRoundTrip(t *testing.T) {
+	cases := []int64{0, 1, 123456}
+	for _, rev := range cases {
+		cursor := revisionToCursor(rev)
+		got, err := cursorToRevision(cursor)
+		if err != nil {
+			t.Fatalf("cursorToRevision(%q) failed: %v", cursor, err)
+		}
+		if got != rev {
+			t.Errorf("round trip of revision %d produced %d", rev, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	ejson "encoding/json"
+	"reflect"
+	"regexp"
+
+	"configcenter/src/common"
+	"configcenter/src/common/json"
+	"configcenter/src/common/watch"
+)
+
+// indexedAttrFields lists the detail fields that are copied onto a
+// ChainNode's Attrs at write time, so a Filter predicate against one of
+// them can be resolved without reading the event's detail from redis.
+var indexedAttrFields = []string{
+	common.BKAppIDField,
+	common.BkSupplierAccount,
+	common.BKObjIDField,
+}
+
+// FilterOp is a single comparison a Filter predicate can perform.
+type FilterOp string
+
+const (
+	FilterOpEqual    FilterOp = "eq"
+	FilterOpNotEqual FilterOp = "ne"
+	FilterOpIn       FilterOp = "in"
+	FilterOpGreater  FilterOp = "gt"
+	FilterOpLess     FilterOp = "lt"
+	FilterOpRegex    FilterOp = "regex"
+	FilterOpExists   FilterOp = "exists"
+)
+
+// Predicate is a single field/op/value test converted from the wire-level
+// watch.FilterCondition DSL carried on watch.WatchEventOptions.Filter.
+type Predicate struct {
+	Field string      `json:"field"`
+	Op    FilterOp    `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// ToPredicates converts the wire-level watch.Filter DSL into the Predicate
+// form evaluated by this package.
+func ToPredicates(filter []watch.FilterCondition) []Predicate {
+	if len(filter) == 0 {
+		return nil
+	}
+	predicates := make([]Predicate, len(filter))
+	for idx, f := range filter {
+		predicates[idx] = Predicate{Field: f.Field, Op: FilterOp(f.Op), Value: f.Value}
+	}
+	return predicates
+}
+
+// SplitPredicates separates predicates into the ones that can be resolved
+// against a ChainNode's indexed Attrs and the ones that need the event's
+// full detail, so a node can be rejected from its Attrs alone before paying
+// for a redis detail read, falling back to the detail only for the rest.
+func SplitPredicates(predicates []Predicate) (nodeLevel, detailLevel []Predicate) {
+	indexed := make(map[string]bool, len(indexedAttrFields))
+	for _, field := range indexedAttrFields {
+		indexed[field] = true
+	}
+
+	for _, p := range predicates {
+		if indexed[p.Field] {
+			nodeLevel = append(nodeLevel, p)
+			continue
+		}
+		detailLevel = append(detailLevel, p)
+	}
+	return nodeLevel, detailLevel
+}
+
+// MatchAttrs reports whether every predicate is satisfied by attrs, where
+// attrs is a ChainNode's indexed attribute map (bk_biz_id, bk_obj_id, ...).
+// A predicate whose field is absent from attrs does not match, except an
+// exists predicate with a false value, which matches exactly that case.
+func MatchAttrs(predicates []Predicate, attrs map[string]interface{}) bool {
+	for _, p := range predicates {
+		val, ok := attrs[p.Field]
+		if p.Op == FilterOpExists {
+			if ok != truthy(p.Value) {
+				return false
+			}
+			continue
+		}
+		if !ok {
+			return false
+		}
+		if !matchOne(p, val) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchDetail reports whether every predicate is satisfied by an event's raw
+// json detail. It's the second-stage evaluator run after the redis pipeline
+// fetch, for predicates SplitPredicates couldn't resolve from the chain
+// node's Attrs alone.
+func MatchDetail(predicates []Predicate, detail string) bool {
+	if len(predicates) == 0 {
+		return true
+	}
+
+	fields := make([]string, len(predicates))
+	for idx, p := range predicates {
+		fields[idx] = p.Field
+	}
+	cut := json.CutJsonDataWithFields(&detail, fields)
+
+	values := make(map[string]interface{})
+	if err := ejson.Unmarshal([]byte(*cut), &values); err != nil {
+		return false
+	}
+	return MatchAttrs(predicates, values)
+}
+
+func truthy(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+func matchOne(p Predicate, val interface{}) bool {
+	switch p.Op {
+	case FilterOpEqual, "":
+		return reflect.DeepEqual(val, p.Value)
+	case FilterOpNotEqual:
+		return !reflect.DeepEqual(val, p.Value)
+	case FilterOpIn:
+		values, ok := p.Value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if reflect.DeepEqual(val, v) {
+				return true
+			}
+		}
+		return false
+	case FilterOpGreater:
+		a, b, ok := asFloats(val, p.Value)
+		return ok && a > b
+	case FilterOpLess:
+		a, b, ok := asFloats(val, p.Value)
+		return ok && a < b
+	case FilterOpRegex:
+		pattern, ok := p.Value.(string)
+		if !ok {
+			return false
+		}
+		str, ok := val.(string)
+		if !ok {
+			return false
+		}
+		matched, err := regexp.MatchString(pattern, str)
+		return err == nil && matched
+	default:
+		return false
+	}
+}
+
+func asFloats(a, b interface{}) (float64, float64, bool) {
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	return af, bf, aok && bok
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// buildChainNodeAttrs extracts the indexable attrs from a newly written
+// event's detail, for the cursor-chain writer to persist onto the
+// ChainNode alongside the rest of its chain metadata.
+func buildChainNodeAttrs(detail map[string]interface{}) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(indexedAttrFields))
+	for _, field := range indexedAttrFields {
+		if val, ok := detail[field]; ok {
+			attrs[field] = val
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,130 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import "testing"
+
+func TestSplitPredicates(t *testing.T) {
+	predicates := []Predicate{
+		{Field: "bk_biz_id", Op: FilterOpEqual, Value: float64(2)},
+		{Field: "bk_obj_id", Op: FilterOpEqual, Value: "host"},
+		{Field: "ip", Op: FilterOpEqual, Value: "127.0.0.1"},
+	}
+
+	nodeLevel, detailLevel := SplitPredicates(predicates)
+	if len(nodeLevel) != 2 {
+		t.Fatalf("expected 2 node-level predicates, got %d", len(nodeLevel))
+	}
+	if len(detailLevel) != 1 {
+		t.Fatalf("expected 1 detail-level predicate, got %d", len(detailLevel))
+	}
+	if detailLevel[0].Field != "ip" {
+		t.Fatalf("expected detail-level predicate on 'ip', got %q", detailLevel[0].Field)
+	}
+}
+
+func TestMatchAttrs(t *testing.T) {
+	attrs := map[string]interface{}{"bk_biz_id": float64(2), "bk_obj_id": "host"}
+
+	cases := []struct {
+		name       string
+		predicates []Predicate
+		want       bool
+	}{
+		{
+			name:       "all predicates match",
+			predicates: []Predicate{{Field: "bk_biz_id", Op: FilterOpEqual, Value: float64(2)}},
+			want:       true,
+		},
+		{
+			name:       "value mismatch",
+			predicates: []Predicate{{Field: "bk_biz_id", Op: FilterOpEqual, Value: float64(3)}},
+			want:       false,
+		},
+		{
+			name:       "field absent from attrs",
+			predicates: []Predicate{{Field: "bk_supplier_account", Op: FilterOpEqual, Value: "0"}},
+			want:       false,
+		},
+		{
+			name:       "exists true matches a present field",
+			predicates: []Predicate{{Field: "bk_obj_id", Op: FilterOpExists, Value: true}},
+			want:       true,
+		},
+		{
+			name:       "exists false matches an absent field",
+			predicates: []Predicate{{Field: "bk_supplier_account", Op: FilterOpExists, Value: false}},
+			want:       true,
+		},
+		{
+			name: "in matches one of the listed values",
+			predicates: []Predicate{
+				{Field: "bk_obj_id", Op: FilterOpIn, Value: []interface{}{"host", "module"}},
+			},
+			want: true,
+		},
+		{
+			name:       "gt compares numeric values",
+			predicates: []Predicate{{Field: "bk_biz_id", Op: FilterOpGreater, Value: float64(1)}},
+			want:       true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := MatchAttrs(c.predicates, attrs); got != c.want {
+				t.Errorf("MatchAttrs() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMatchOne(t *testing.T) {
+	cases := []struct {
+		name string
+		p    Predicate
+		val  interface{}
+		want bool
+	}{
+		{name: "eq match", p: Predicate{Op: FilterOpEqual, Value: "host"}, val: "host", want: true},
+		{name: "ne match", p: Predicate{Op: FilterOpNotEqual, Value: "host"}, val: "module", want: true},
+		{name: "regex match", p: Predicate{Op: FilterOpRegex, Value: "^ho"}, val: "host", want: true},
+		{name: "regex no match", p: Predicate{Op: FilterOpRegex, Value: "^mo"}, val: "host", want: false},
+		{name: "lt match", p: Predicate{Op: FilterOpLess, Value: float64(10)}, val: float64(5), want: true},
+		{name: "unknown op", p: Predicate{Op: "nope", Value: "host"}, val: "host", want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchOne(c.p, c.val); got != c.want {
+				t.Errorf("matchOne() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBuildChainNodeAttrs(t *testing.T) {
+	detail := map[string]interface{}{
+		"bk_biz_id":           float64(2),
+		"bk_supplier_account": "0",
+		"ip":                  "127.0.0.1",
+	}
+
+	attrs := buildChainNodeAttrs(detail)
+	if len(attrs) != 2 {
+		t.Fatalf("expected 2 indexed attrs, got %d: %v", len(attrs), attrs)
+	}
+	if _, ok := attrs["ip"]; ok {
+		t.Fatal("buildChainNodeAttrs should not copy non-indexed fields")
+	}
+}
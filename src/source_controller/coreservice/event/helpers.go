@@ -0,0 +1,174 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"strconv"
+	"time"
+
+	"configcenter/src/common/json"
+	"configcenter/src/common/watch"
+	"gopkg.in/redis.v5"
+)
+
+// chainNodeKey is where a single chain node's metadata is persisted, keyed
+// by its own cursor.
+func chainNodeKey(key Key, cursor string) string {
+	return key.Namespace() + ":node:" + cursor
+}
+
+// getHeadTailNode reads the chain's head and tail sentinel nodes, which
+// always point at the first and last real node via NextCursor.
+func getHeadTailNode(cache *redis.Client, key Key) (head, tail *watch.ChainNode, err error) {
+	headStr, err := cache.Get(chainNodeKey(key, key.HeadKey())).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	tailStr, err := cache.Get(chainNodeKey(key, key.TailKey())).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	head = new(watch.ChainNode)
+	if err := json.Unmarshal([]byte(headStr), head); err != nil {
+		return nil, nil, err
+	}
+	tail = new(watch.ChainNode)
+	if err := json.Unmarshal([]byte(tailStr), tail); err != nil {
+		return nil, nil, err
+	}
+	return head, tail, nil
+}
+
+// getNodesFromCursor walks the chain forward from the node right after
+// cursor, returning up to step nodes in order.
+func getNodesFromCursor(cache *redis.Client, step int, cursor string, key Key) ([]*watch.ChainNode, error) {
+	nodes := make([]*watch.ChainNode, 0, step)
+	start, err := getNode(cache, key, cursor)
+	if err == redis.Nil {
+		return nodes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	next := start.NextCursor
+	for i := 0; i < step && next != key.TailKey(); i++ {
+		str, err := cache.Get(chainNodeKey(key, next)).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		node := new(watch.ChainNode)
+		if err := json.Unmarshal([]byte(str), node); err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+		next = node.NextCursor
+	}
+	return nodes, nil
+}
+
+// getNode fetches a single chain node's metadata by cursor.
+func getNode(cache *redis.Client, key Key, cursor string) (*watch.ChainNode, error) {
+	str, err := cache.Get(chainNodeKey(key, cursor)).Result()
+	if err != nil {
+		return nil, err
+	}
+	node := new(watch.ChainNode)
+	if err := json.Unmarshal([]byte(str), node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// saveNode persists node's chain metadata with the chain's configured TTL.
+func saveNode(cache *redis.Client, key Key, node *watch.ChainNode, ttl time.Duration) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return cache.Set(chainNodeKey(key, node.Cursor), data, ttl).Err()
+}
+
+// pushChainNode appends a new node to the chain for an event of eventType
+// on detail, linking it in right after the current tail and updating the
+// head/tail sentinels as needed, and returns the node it wrote.
+//
+// The chain is a ring of sentinels: the head sentinel's NextCursor always
+// points at the first real node (or at the tail sentinel's own cursor when
+// the chain is empty), and symmetrically the tail sentinel's NextCursor
+// always points at the last real node (or at the head sentinel's cursor
+// when empty) so getLatestEventDetail can find the newest event without a
+// full scan.
+func pushChainNode(cache *redis.Client, key Key, eventType watch.EventType, detail map[string]interface{}) (*watch.ChainNode, error) {
+	seq, err := cache.Incr(key.Namespace() + ":seq").Result()
+	if err != nil {
+		return nil, err
+	}
+	cursor := strconv.FormatInt(seq, 10)
+	ttl := time.Duration(key.TTLSeconds()) * time.Second
+
+	head, tail, err := getHeadTailNode(cache, key)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &watch.ChainNode{
+		Cursor:      cursor,
+		NextCursor:  key.TailKey(),
+		ClusterTime: watch.TimeStamp{Sec: uint32(time.Now().Unix())},
+		EventType:   eventType,
+		Attrs:       buildChainNodeAttrs(detail),
+	}
+
+	previousLast := tail.NextCursor
+	if previousLast == key.HeadKey() {
+		// the chain was empty, this node is also the new first node.
+		head.NextCursor = cursor
+	} else {
+		prevNode, err := getNode(cache, key, previousLast)
+		if err != nil {
+			return nil, err
+		}
+		prevNode.NextCursor = cursor
+		if err := saveNode(cache, key, prevNode, ttl); err != nil {
+			return nil, err
+		}
+	}
+	tail.NextCursor = cursor
+
+	if err := saveNode(cache, key, node, ttl); err != nil {
+		return nil, err
+	}
+	if err := saveNode(cache, key, head, ttl); err != nil {
+		return nil, err
+	}
+	if err := saveNode(cache, key, tail, ttl); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Set(key.DetailKey(cursor), data, ttl).Err(); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
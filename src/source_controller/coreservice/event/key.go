@@ -0,0 +1,31 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+// Key locates the cursor chain and event details for a single watchable
+// resource, regardless of which Store backend actually holds them.
+type Key interface {
+	// Namespace is the key prefix this resource's chain and details live
+	// under, e.g. "watch:host".
+	Namespace() string
+	// HeadKey is the sentinel cursor that precedes the first real node in
+	// the chain.
+	HeadKey() string
+	// TailKey is the sentinel cursor that follows the last real node in the
+	// chain.
+	TailKey() string
+	// DetailKey is the key holding the json detail for cursor.
+	DetailKey(cursor string) string
+	// TTLSeconds is how long the chain and its details are retained for.
+	TTLSeconds() int64
+}
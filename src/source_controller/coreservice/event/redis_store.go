@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"context"
+
+	"configcenter/src/common/watch"
+	"gopkg.in/redis.v5"
+)
+
+// redisStore is the long standing Store implementation, it keeps the cursor
+// chain and event details in redis and is what watchWithCursor used to talk
+// to directly before the Store abstraction existed.
+type redisStore struct {
+	cache *redis.Client
+	key   Key
+}
+
+// globalRedisClient is the watch service's own redis client, the same one
+// it used directly before this Store abstraction was introduced.
+var globalRedisClient *redis.Client
+
+// SetRedisClient wires the shared redis client into the event package so
+// newRedisStore can use it. event_server's watch service calls it once, the
+// first time it resolves a Store.
+func SetRedisClient(client *redis.Client) {
+	globalRedisClient = client
+}
+
+func newRedisStore(key Key) (Store, error) {
+	return &redisStore{
+		cache: globalRedisClient,
+		key:   key,
+	}, nil
+}
+
+func (s *redisStore) Namespace() string {
+	return s.key.Namespace()
+}
+
+func (s *redisStore) TTL() int64 {
+	return s.key.TTLSeconds()
+}
+
+func (s *redisStore) GetHeadTail(key Key) (head, tail *watch.ChainNode, err error) {
+	return getHeadTailNode(s.cache, key)
+}
+
+func (s *redisStore) GetNodesFromCursor(step int, cursor string, key Key) ([]*watch.ChainNode, error) {
+	return getNodesFromCursor(s.cache, step, cursor, key)
+}
+
+func (s *redisStore) GetNode(key Key, cursor string) (*watch.ChainNode, error) {
+	return getNode(s.cache, key, cursor)
+}
+
+func (s *redisStore) GetDetail(key Key, cursor string) (string, error) {
+	return s.cache.Get(key.DetailKey(cursor)).Result()
+}
+
+func (s *redisStore) PushNode(key Key, eventType watch.EventType, detail map[string]interface{}) (*watch.ChainNode, error) {
+	return pushChainNode(s.cache, key, eventType, detail)
+}
+
+// ResolveStartFrom reports that redis keeps no time index to translate
+// StartFrom with, the caller falls back to scanning the chain from the
+// head instead.
+func (s *redisStore) ResolveStartFrom(key Key, startFrom int64) (string, bool, error) {
+	return "", false, nil
+}
+
+// Watch reports that redis has no push mechanism to offer, the caller
+// falls back to its own poll-and-sleep loop.
+func (s *redisStore) Watch(ctx context.Context, key Key, cursor string) (<-chan *watch.ChainNode, bool) {
+	return nil, false
+}
+
+func (s *redisStore) PipelineGetDetails(key Key, cursors []string) ([]string, error) {
+	pipe := s.cache.Pipeline()
+	results := make([]*redis.StringCmd, len(cursors))
+	for idx, cursor := range cursors {
+		results[idx] = pipe.Get(key.DetailKey(cursor))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	details := make([]string, len(cursors))
+	for idx, result := range results {
+		details[idx] = result.Val()
+	}
+	return details, nil
+}
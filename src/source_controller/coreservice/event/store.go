@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package event
+
+import (
+	"context"
+
+	"configcenter/src/common/watch"
+)
+
+// StoreType is the name of a pluggable event store backend.
+type StoreType string
+
+const (
+	// StoreTypeRedis keeps the cursor chain and event details in redis, the
+	// long standing default backend.
+	StoreTypeRedis StoreType = "redis"
+	// StoreTypeEtcd keeps the cursor chain and event details in etcd v3 and
+	// lets watchers block on clientv3.Watch instead of polling redis.
+	StoreTypeEtcd StoreType = "etcd"
+)
+
+// Store abstracts the operations the watch service needs to perform against
+// whatever backend holds the cursor chain and event details. Every method
+// that used to be a direct s.cache call in the watch service is represented
+// here so a backend can be swapped without touching the watch logic itself.
+type Store interface {
+	// Namespace returns the key namespace this store instance serves, e.g.
+	// the resource's cursor type.
+	Namespace() string
+
+	// TTL returns the configured retention of the underlying cursor chain,
+	// in seconds.
+	TTL() int64
+
+	// GetHeadTail returns the chain's head and tail target nodes.
+	GetHeadTail(key Key) (head, tail *watch.ChainNode, err error)
+
+	// GetNodesFromCursor scans at most step nodes starting right after
+	// cursor, returning them in chain order.
+	GetNodesFromCursor(step int, cursor string, key Key) ([]*watch.ChainNode, error)
+
+	// GetNode fetches a single chain node's metadata by cursor.
+	GetNode(key Key, cursor string) (*watch.ChainNode, error)
+
+	// GetDetail fetches a single event detail by cursor.
+	GetDetail(key Key, cursor string) (string, error)
+
+	// PipelineGetDetails fetches the event details for a batch of cursors
+	// in one round trip where the backend supports it.
+	PipelineGetDetails(key Key, cursors []string) ([]string, error)
+
+	// PushNode appends a new node to key's cursor chain for an event of
+	// eventType on detail, returning the node it wrote with its assigned
+	// cursor.
+	PushNode(key Key, eventType watch.EventType, detail map[string]interface{}) (*watch.ChainNode, error)
+
+	// ResolveStartFrom translates a StartFrom unix-seconds value into a
+	// cursor to scan forward from, using an index the backend maintains at
+	// write time, so a watcher can skip straight to the right neighbourhood
+	// of the chain instead of scanning from the head. ok is false when the
+	// backend keeps no such index, and the caller should fall back to a
+	// full scan from the head.
+	ResolveStartFrom(key Key, startFrom int64) (cursor string, ok bool, err error)
+
+	// Watch returns a channel that receives each new node landing in key's
+	// chain after cursor until ctx is cancelled, for backends that can push
+	// instead of being polled. ok is false when the backend keeps no such
+	// mechanism, and the caller should fall back to sleeping and retrying.
+	Watch(ctx context.Context, key Key, cursor string) (ch <-chan *watch.ChainNode, ok bool)
+}
+
+// NewStore builds the configured Store implementation for resource's
+// namespace. typ is read from the coreservice configuration at startup so
+// operators can choose the backend that matches their existing infra.
+func NewStore(typ StoreType, key Key) (Store, error) {
+	switch typ {
+	case StoreTypeEtcd:
+		return newEtcdStore(key)
+	case StoreTypeRedis, "":
+		return newRedisStore(key)
+	default:
+		return nil, ErrUnknownStoreType(typ)
+	}
+}
+
+// ErrUnknownStoreType reports a StoreType that has no registered Store
+// implementation.
+type ErrUnknownStoreType StoreType
+
+func (e ErrUnknownStoreType) Error() string {
+	return "unknown event store type: " + string(e)
+}